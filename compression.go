@@ -0,0 +1,114 @@
+package fsutil
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Compression identifies a codec PACKET_DATA is framed with. The zero
+// value, CompressionNone, always works and is the fallback when peers
+// don't share a codec.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+// negotiate returns the first codec in preferenceOrder also present in
+// available, or CompressionNone if the two share nothing.
+func negotiate(preferenceOrder, available []Compression) Compression {
+	supported := make(map[Compression]struct{}, len(available))
+	for _, c := range available {
+		supported[c] = struct{}{}
+	}
+	for _, c := range preferenceOrder {
+		if _, ok := supported[c]; ok {
+			return c
+		}
+	}
+	return CompressionNone
+}
+
+// supportedCompressions returns this side's codecs in preference order,
+// always ending in CompressionNone.
+func supportedCompressions(preferred Compression) []Compression {
+	if preferred == CompressionNone {
+		return []Compression{CompressionNone}
+	}
+	return []Compression{preferred, CompressionNone}
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// newEncoder wraps w with the given codec. Closing it flushes the codec's
+// trailer but does not close w.
+func newEncoder(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		gw := gzipWriterPool.Get().(*gzip.Writer)
+		gw.Reset(w)
+		return &pooledGzipWriter{Writer: gw}, nil
+	default:
+		return nil, errors.Errorf("unsupported compression %s", c)
+	}
+}
+
+// newDecoder wraps r with the given codec.
+func newDecoder(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionNone:
+		return ioutilNopCloser{r}, nil
+	case CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return gr, nil
+	default:
+		return nil, errors.Errorf("unsupported compression %s", c)
+	}
+}
+
+type pooledGzipWriter struct {
+	*gzip.Writer
+}
+
+func (w *pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	gzipWriterPool.Put(w.Writer)
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type ioutilNopCloser struct {
+	io.Reader
+}
+
+func (ioutilNopCloser) Close() error { return nil }
@@ -0,0 +1,77 @@
+package fsutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		name      string
+		preferred []Compression
+		available []Compression
+		want      Compression
+	}{
+		{"shared codec wins", []Compression{CompressionGzip, CompressionNone}, []Compression{CompressionNone, CompressionGzip}, CompressionGzip},
+		{"falls back to none", []Compression{CompressionGzip, CompressionNone}, []Compression{CompressionNone}, CompressionNone},
+		{"no shared codec at all", []Compression{CompressionGzip}, []Compression{}, CompressionNone},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := negotiate(tc.preferred, tc.available); got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSupportedCompressionsAlwaysEndsInNone(t *testing.T) {
+	got := supportedCompressions(CompressionGzip)
+	if len(got) == 0 || got[len(got)-1] != CompressionNone {
+		t.Fatalf("expected list ending in CompressionNone, got %v", got)
+	}
+
+	got = supportedCompressions(CompressionNone)
+	if len(got) != 1 || got[0] != CompressionNone {
+		t.Fatalf("expected [CompressionNone], got %v", got)
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip} {
+		t.Run(c.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, err := newEncoder(&buf, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := enc.Write([]byte("hello world")); err != nil {
+				t.Fatal(err)
+			}
+			if err := enc.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			dec, err := newDecoder(&buf, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dec.Close()
+
+			dt, err := ioutil.ReadAll(dec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(dt) != "hello world" {
+				t.Fatalf("expected %q, got %q", "hello world", dt)
+			}
+		})
+	}
+}
+
+func TestNewEncoderRejectsUnknownCodec(t *testing.T) {
+	if _, err := newEncoder(ioutil.Discard, Compression(99)); err == nil {
+		t.Fatal("expected error for unknown compression")
+	}
+}
@@ -0,0 +1,15 @@
+package fsutil
+
+import (
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ContentStore lets Send/Receive dedup file contents by digest instead of
+// always streaming them over the wire.
+type ContentStore interface {
+	Has(dgst digest.Digest) bool
+	OpenReader(dgst digest.Digest) (io.ReadCloser, error)
+	Writer(dgst digest.Digest) (io.WriteCloser, error)
+}
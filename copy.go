@@ -5,9 +5,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Sirupsen/logrus"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -26,16 +29,31 @@ func Send(ctx context.Context, conn Stream, root string, opt *WalkOpt, progressC
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	concurrency := opt.SendConcurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
 	s := &sender{
 		ctx:        ctx,
 		cancel:     cancel,
 		conn:       &syncStream{Stream: conn},
 		root:       root,
 		opt:        opt,
-		files:      make(map[uint32]string),
+		digests:    make(map[uint32]digest.Digest),
+		reqs:       make(chan sendReq, concurrency),
 		progressCb: progressCb,
 	}
-	return s.run()
+	if err := s.negotiateCompression(); err != nil {
+		return errors.Wrap(err, "failed to negotiate compression")
+	}
+	return s.run(concurrency)
+}
+
+type sendReq struct {
+	id            uint32
+	path          string
+	offset, limit int64
 }
 
 type sender struct {
@@ -44,59 +62,147 @@ type sender struct {
 	cancel          func()
 	opt             *WalkOpt
 	root            string
-	files           map[uint32]string
+	files           atomic.Value // []string, index i holds the path for file id i
+	requested       sync.Map     // uint32 -> struct{}, dedupes PACKET_REQ without a mutex
+	reqs            chan sendReq
+	digests         map[uint32]digest.Digest
+	have            map[digest.Digest]struct{}
+	compression     Compression
 	mu              sync.RWMutex
 	progressCb      func(int, bool)
 	progressCurrent int
 }
 
-func (s *sender) run() error {
+func (s *sender) updateProgress(size int, last bool) {
+	if s.progressCb != nil {
+		s.progressCurrent += size
+		s.progressCb(s.progressCurrent, last)
+	}
+}
+
+func (s *sender) negotiateCompression() error {
+	mine := supportedCompressions(s.opt.Compression)
+	if err := s.conn.SendMsg(&Packet{Type: PACKET_HELLO, Compressions: mine}); err != nil {
+		return err
+	}
+	var p Packet
+	if err := s.conn.RecvMsg(&p); err != nil {
+		return err
+	}
+	if p.Type != PACKET_HELLO {
+		return errors.Errorf("expected hello packet, got %d", p.Type)
+	}
+	s.compression = negotiate(mine, p.Compressions)
+	return nil
+}
+
+func (s *sender) run(concurrency int) error {
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker()
+		}()
+	}
+
 	go s.send()
 	defer s.updateProgress(0, true)
 	for {
 		var p Packet
 		if err := s.conn.RecvMsg(&p); err == nil {
 			switch p.Type {
+			case PACKET_HAVE:
+				s.mu.Lock()
+				s.have = make(map[digest.Digest]struct{}, len(p.Haves))
+				for _, dgst := range p.Haves {
+					s.have[dgst] = struct{}{}
+				}
+				s.mu.Unlock()
 			case PACKET_REQ:
-				if err := s.queue(p.ID); err != nil {
+				if err := s.queue(p.ID, p.Offset, p.Length); err != nil {
 					return err
 				}
 			case PACKET_FIN:
+				close(s.reqs)
+				wg.Wait()
 				return s.conn.SendMsg(&Packet{Type: PACKET_FIN})
 			}
 		}
 	}
 }
 
-func (s *sender) updateProgress(size int, last bool) {
-	if s.progressCb != nil {
-		s.progressCurrent += size
-		s.progressCb(s.progressCurrent, last)
+func (s *sender) worker() {
+	for req := range s.reqs {
+		if err := s.sendFile(req.id, req.path, req.offset, req.limit); err != nil {
+			if s.opt.ErrorCb != nil {
+				s.opt.ErrorCb(req.path, err)
+			} else {
+				logrus.Errorf("failed to send %s: %+v", req.path, err)
+			}
+		}
 	}
 }
 
-func (s *sender) queue(id uint32) error {
-	// TODO: add worker threads
-	// TODO: use something faster than map
-	s.mu.Lock()
-	p, ok := s.files[id]
+func (s *sender) pathForID(id uint32) (string, bool) {
+	files, _ := s.files.Load().([]string)
+	if int(id) >= len(files) {
+		return "", false
+	}
+	return files[id], true
+}
+
+func (s *sender) queue(id uint32, offset, length int64) error {
+	p, ok := s.pathForID(id)
 	if !ok {
-		s.mu.Unlock()
 		return errors.Errorf("invalid file id %d", id)
 	}
-	delete(s.files, id)
-	s.mu.Unlock()
-	go s.sendFile(id, p)
+	// Lazy mode may request the same id multiple times for different
+	// ranges, so only dedupe full-file requests.
+	if offset == 0 && length == 0 {
+		if _, dup := s.requested.LoadOrStore(id, struct{}{}); dup {
+			return nil
+		}
+	}
+
+	s.mu.RLock()
+	dgst, hasDigest := s.digests[id]
+	_, known := s.have[dgst]
+	s.mu.RUnlock()
+	if hasDigest && known {
+		return s.conn.SendMsg(&Packet{ID: id, Type: PACKET_REF, Digest: dgst})
+	}
+
+	// Blocks once reqs is full, applying backpressure instead of spawning
+	// an unbounded goroutine per queued request.
+	s.reqs <- sendReq{id: id, path: p, offset: offset, limit: length}
 	return nil
 }
 
-func (s *sender) sendFile(id uint32, p string) error {
+func (s *sender) sendFile(id uint32, p string, offset, length int64) error {
 	f, err := os.Open(filepath.Join(s.root, p))
 	if err == nil {
+		defer f.Close()
+		if length <= 0 {
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			length = fi.Size() - offset
+		}
 		buf := bufPool.Get().([]byte)
 		defer bufPool.Put(buf)
-		if _, err := io.CopyBuffer(&fileSender{sender: s, id: id}, f, buf); err != nil {
-			return err // TODO: handle error
+		sr := io.NewSectionReader(f, offset, length)
+		var dst io.Writer = &fileSender{sender: s, id: id}
+		enc, err := newEncoder(dst, s.compression)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyBuffer(enc, sr, buf); err != nil {
+			return errors.Wrapf(err, "failed to send file %s", p)
+		}
+		if err := enc.Close(); err != nil {
+			return errors.Wrapf(err, "failed to flush %s", p)
 		}
 	}
 	return s.conn.SendMsg(&Packet{ID: id, Type: PACKET_DATA})
@@ -104,6 +210,7 @@ func (s *sender) sendFile(id uint32, p string) error {
 
 func (s *sender) send() error {
 	var i uint32 = 0
+	files := make([]string, 0, 1024)
 	err := Walk(s.ctx, s.root, s.opt, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -112,14 +219,27 @@ func (s *sender) send() error {
 		if !ok {
 			return errors.Wrapf(err, "invalid fileinfo without stat info: %s", path)
 		}
+		var dgst digest.Digest
+		if (s.opt.ContentStore != nil || s.opt.ResumeJournal != nil) && fi.Mode().IsRegular() {
+			d, err := digestPath(filepath.Join(s.root, path))
+			if err != nil {
+				return errors.Wrapf(err, "failed to digest %s", path)
+			}
+			dgst = d
+			stat.Digest = string(dgst)
+		}
 		p := &Packet{
 			Type: PACKET_STAT,
 			Stat: stat,
 		}
-		s.mu.Lock()
-		s.files[i] = stat.Path
+		files = append(files, stat.Path)
+		s.files.Store(files)
+		if dgst != "" {
+			s.mu.Lock()
+			s.digests[i] = dgst
+			s.mu.Unlock()
+		}
 		i++
-		s.mu.Unlock()
 		s.updateProgress(p.Size(), false)
 		return errors.Wrapf(s.conn.SendMsg(p), "failed to send stat %s", path)
 	})
@@ -129,6 +249,19 @@ func (s *sender) send() error {
 	return errors.Wrapf(s.conn.SendMsg(&Packet{Type: PACKET_STAT}), "failed to send last stat")
 }
 
+func digestPath(p string) (digest.Digest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dgst, err := digest.Canonical.FromReader(f)
+	if err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
+
 type fileSender struct {
 	sender *sender
 	id     uint32
@@ -158,33 +291,64 @@ func (ss *syncStream) SendMsg(m interface{}) error {
 	return err
 }
 
+// ReceiveOpt configures ReceiveWithOpt. The zero value disables dedup and
+// resume and only accepts uncompressed transfers.
+type ReceiveOpt struct {
+	ContentStore ContentStore
+	Journal      *Journal
+	Compression  Compression
+}
+
 func Receive(ctx context.Context, conn Stream, dest string) error {
+	return ReceiveWithOpt(ctx, conn, dest, ReceiveOpt{Compression: CompressionGzip})
+}
+
+// ReceiveWithContentStore behaves like Receive but consults store for
+// digests the receiver already has locally, letting the sender skip
+// retransmitting their content and instead reference the store directly.
+func ReceiveWithContentStore(ctx context.Context, conn Stream, dest string, store ContentStore) error {
+	return ReceiveWithOpt(ctx, conn, dest, ReceiveOpt{ContentStore: store, Compression: CompressionGzip})
+}
+
+// ReceiveWithOpt behaves like Receive but allows the caller to configure
+// content-addressed dedup, resumable journaling and the preferred
+// compression codec.
+func ReceiveWithOpt(ctx context.Context, conn Stream, dest string, opt ReceiveOpt) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	r := &receiver{
 		ctx: ctx,
 		// cancel: cancel,
-		conn:     &syncStream{Stream: conn},
-		dest:     dest,
-		files:    make(map[string]uint32),
-		pipes:    make(map[uint32]*io.PipeWriter),
-		walkChan: make(chan *currentPath, 128),
-		walkDone: make(chan struct{}),
+		conn:           &syncStream{Stream: conn},
+		dest:           dest,
+		store:          opt.ContentStore,
+		journal:        opt.Journal,
+		preferredCompr: opt.Compression,
+		files:          make(map[string]uint32),
+		pipes:          make(map[uint32]*io.PipeWriter),
+		walkChan:       make(chan *currentPath, 128),
+		walkDone:       make(chan struct{}),
 	}
 	return r.run()
 }
 
 type receiver struct {
-	dest     string
-	ctx      context.Context
-	conn     Stream
-	files    map[string]uint32
-	pipes    map[uint32]*io.PipeWriter
-	mu       sync.RWMutex
-	muPipes  sync.RWMutex
-	walkChan chan *currentPath
-	walkDone chan struct{}
+	dest           string
+	ctx            context.Context
+	conn           Stream
+	store          ContentStore
+	files          map[string]uint32
+	pipes          map[uint32]*io.PipeWriter
+	mu             sync.RWMutex
+	muPipes        sync.RWMutex
+	walkChan       chan *currentPath
+	walkDone       chan struct{}
+	fileDigests    map[string]digest.Digest
+	fileModes      map[string]os.FileMode
+	compression    Compression
+	preferredCompr Compression
+	journal        *Journal
 }
 
 func (r *receiver) readStat(ctx context.Context, pathC chan<- *currentPath) error {
@@ -194,7 +358,24 @@ func (r *receiver) readStat(ctx context.Context, pathC chan<- *currentPath) erro
 	return nil
 }
 
+func (r *receiver) negotiateCompression() error {
+	var p Packet
+	if err := r.conn.RecvMsg(&p); err != nil {
+		return err
+	}
+	if p.Type != PACKET_HELLO {
+		return errors.Errorf("expected hello packet, got %d", p.Type)
+	}
+	mine := supportedCompressions(r.preferredCompr)
+	r.compression = negotiate(p.Compressions, mine)
+	return r.conn.SendMsg(&Packet{Type: PACKET_HELLO, Compressions: mine})
+}
+
 func (r *receiver) run() error {
+	if err := r.negotiateCompression(); err != nil {
+		return errors.Wrap(err, "failed to negotiate compression")
+	}
+
 	dw := DiskWriter{
 		asyncDataFunc: r.getAsyncDataFunc(),
 		dest:          r.dest,
@@ -222,11 +403,34 @@ func (r *receiver) run() error {
 					}()
 					break
 				}
+				hasNewDigest := false
 				if os.FileMode(p.Stat.Mode)&(os.ModeDir|os.ModeSymlink|os.ModeNamedPipe|os.ModeDevice) == 0 {
 					r.mu.Lock()
 					r.files[p.Stat.Path] = i
+					if p.Stat.Digest != "" {
+						if r.fileDigests == nil {
+							r.fileDigests = make(map[string]digest.Digest)
+						}
+						r.fileDigests[p.Stat.Path] = digest.Digest(p.Stat.Digest)
+						hasNewDigest = true
+					}
+					if r.journal != nil {
+						if r.fileModes == nil {
+							r.fileModes = make(map[string]os.FileMode)
+						}
+						r.fileModes[p.Stat.Path] = os.FileMode(p.Stat.Mode)
+					}
 					r.mu.Unlock()
 				}
+				// DiskWriter starts requesting files off walkChan as soon as
+				// they're pushed, concurrently with the rest of the incoming
+				// TOC, so the sender must already know what we have before
+				// that push - not after the whole tree has streamed in.
+				if hasNewDigest && r.store != nil {
+					if err := r.sendHaves(); err != nil {
+						return err
+					}
+				}
 				i++
 				r.walkChan <- &currentPath{path: p.Stat.Path, f: &StatInfo{p.Stat}}
 			case PACKET_DATA:
@@ -246,6 +450,10 @@ func (r *receiver) run() error {
 						return err
 					}
 				}
+			case PACKET_REF:
+				if err := r.writeFromStore(p.ID, p.Digest); err != nil {
+					return err
+				}
 			case PACKET_FIN:
 				return nil
 			}
@@ -256,6 +464,38 @@ func (r *receiver) run() error {
 	return nil
 }
 
+func (r *receiver) sendHaves() error {
+	r.mu.RLock()
+	haves := make([]digest.Digest, 0, len(r.fileDigests))
+	for _, dgst := range r.fileDigests {
+		if r.store.Has(dgst) {
+			haves = append(haves, dgst)
+		}
+	}
+	r.mu.RUnlock()
+	return r.conn.SendMsg(&Packet{Type: PACKET_HAVE, Haves: haves})
+}
+
+func (r *receiver) writeFromStore(id uint32, dgst digest.Digest) error {
+	r.muPipes.Lock()
+	pw, ok := r.pipes[id]
+	r.muPipes.Unlock()
+	if !ok {
+		return errors.Errorf("invalid file reference %d", id)
+	}
+	rc, err := r.store.OpenReader(dgst)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open store content %s", dgst)
+	}
+	defer rc.Close()
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	if _, err := io.CopyBuffer(pw, rc, buf); err != nil {
+		return err
+	}
+	return pw.Close()
+}
+
 func (r *receiver) getAsyncDataFunc() writeToFunc {
 	return func(ctx context.Context, p string, wc io.WriteCloser) error {
 		r.mu.Lock()
@@ -267,6 +507,18 @@ func (r *receiver) getAsyncDataFunc() writeToFunc {
 		delete(r.files, p)
 		r.mu.Unlock()
 
+		if r.journal != nil {
+			return r.resumableDataFunc(ctx, p, id, wc)
+		}
+
+		r.mu.RLock()
+		dgst := r.fileDigests[p]
+		r.mu.RUnlock()
+		// A digest the store already holds will come back as PACKET_REF,
+		// whose content writeFromStore pipes in raw: the decoder must not
+		// run over it a second time.
+		refExpected := r.store != nil && dgst != "" && r.store.Has(dgst)
+
 		pr, pw := io.Pipe()
 		r.muPipes.Lock()
 		r.pipes[id] = pw
@@ -275,11 +527,37 @@ func (r *receiver) getAsyncDataFunc() writeToFunc {
 			return err
 		}
 
+		compression := r.compression
+		if refExpected {
+			compression = CompressionNone
+		}
+		dec, err := newDecoder(pr, compression)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+
+		dst := io.Writer(wc)
+		var storeWriter io.WriteCloser
+		if r.store != nil && dgst != "" && !refExpected {
+			sw, err := r.store.Writer(dgst)
+			if err != nil {
+				return err
+			}
+			storeWriter = sw
+			dst = io.MultiWriter(wc, sw)
+		}
+
 		buf := bufPool.Get().([]byte)
 		defer bufPool.Put(buf)
-		if _, err := io.CopyBuffer(wc, pr, buf); err != nil {
+		if _, err := io.CopyBuffer(dst, dec, buf); err != nil {
 			return err
 		}
+		if storeWriter != nil {
+			if err := storeWriter.Close(); err != nil {
+				return err
+			}
+		}
 		return wc.Close()
 	}
 }
@@ -0,0 +1,55 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type fakeWriteCloser struct {
+	bytes.Buffer
+}
+
+func (fakeWriteCloser) Close() error { return nil }
+
+// TestGetAsyncDataFuncBypassesDecoderForStoreRef covers the dedup+compression
+// interaction: a digest the receiver already has locally is filled in by
+// writeFromStore with raw bytes (a PACKET_REF never goes through the wire
+// codec), so getAsyncDataFunc must not run the negotiated compression's
+// decoder over it.
+func TestGetAsyncDataFuncBypassesDecoderForStoreRef(t *testing.T) {
+	store := newFakeStore()
+	dgst := digest.FromString("payload")
+	store.content[dgst] = []byte("payload")
+
+	toSender := make(chan Packet, 1)
+	r := &receiver{
+		conn:        &benchStream{send: toSender, recv: make(chan Packet)},
+		store:       store,
+		compression: CompressionGzip, // negotiated for the rest of the transfer
+		files:       map[string]uint32{"a": 0},
+		fileDigests: map[string]digest.Digest{"a": dgst},
+		pipes:       map[uint32]*io.PipeWriter{},
+	}
+
+	fn := r.getAsyncDataFunc()
+	var wc fakeWriteCloser
+	done := make(chan error, 1)
+	go func() { done <- fn(context.Background(), "a", &wc) }()
+
+	<-toSender // PACKET_REQ
+
+	if err := r.writeFromStore(0, dgst); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if wc.String() != "payload" {
+		t.Fatalf("expected raw %q to pass through undecoded, got %q", "payload", wc.String())
+	}
+}
@@ -0,0 +1,108 @@
+package fsutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type fakeStore struct {
+	content map[digest.Digest][]byte
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{content: map[digest.Digest][]byte{}}
+}
+
+func (s *fakeStore) Has(dgst digest.Digest) bool {
+	_, ok := s.content[dgst]
+	return ok
+}
+
+func (s *fakeStore) OpenReader(dgst digest.Digest) (io.ReadCloser, error) {
+	dt, ok := s.content[dgst]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(dt)), nil
+}
+
+func (s *fakeStore) Writer(dgst digest.Digest) (io.WriteCloser, error) {
+	return nil, io.ErrClosedPipe
+}
+
+func TestDigestPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsutil-digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(p, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := digestPath(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := digest.FromBytes([]byte("hello"))
+	if got != want {
+		t.Fatalf("expected digest %s, got %s", want, got)
+	}
+}
+
+func TestReceiverSendHavesOnlyStoreContent(t *testing.T) {
+	store := newFakeStore()
+	have := digest.FromString("have")
+	miss := digest.FromString("miss")
+	store.content[have] = []byte("have")
+
+	toSender := make(chan Packet, 1)
+	r := &receiver{
+		conn:        &benchStream{send: toSender, recv: make(chan Packet)},
+		store:       store,
+		fileDigests: map[string]digest.Digest{"a": have, "b": miss},
+	}
+
+	if err := r.sendHaves(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := <-toSender
+	if p.Type != PACKET_HAVE || len(p.Haves) != 1 || p.Haves[0] != have {
+		t.Fatalf("expected PACKET_HAVE with only %s, got %+v", have, p)
+	}
+}
+
+func TestReceiverWriteFromStore(t *testing.T) {
+	store := newFakeStore()
+	dgst := digest.FromString("payload")
+	store.content[dgst] = []byte("payload")
+
+	pr, pw := io.Pipe()
+	r := &receiver{
+		store: store,
+		pipes: map[uint32]*io.PipeWriter{0: pw},
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- r.writeFromStore(0, dgst) }()
+
+	dt, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "payload" {
+		t.Fatalf("expected %q, got %q", "payload", dt)
+	}
+}
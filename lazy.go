@@ -0,0 +1,147 @@
+package fsutil
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PlaceholderBackend materializes files on disk without their content,
+// e.g. a sparse file or a FUSE-backed overlay.
+type PlaceholderBackend interface {
+	CreatePlaceholder(path string, stat *Stat) error
+	// WriteAt fills in a placeholder once Fetch has the data for it.
+	WriteAt(path string, offset int64, p []byte) (int, error)
+}
+
+// LazyReceiver receives a full stat TOC up front but defers fetching file
+// content until Fetch is called for it.
+type LazyReceiver struct {
+	ctx     context.Context
+	conn    Stream
+	backend PlaceholderBackend
+
+	mu   sync.Mutex
+	ids  map[string]uint32
+	toc  map[string]*Stat
+	next uint32
+
+	muPending sync.Mutex
+	pending   map[uint32]chan *Packet
+}
+
+// negotiateCompression replies to Send's PACKET_HELLO. It only advertises
+// CompressionNone since Fetch writes raw PACKET_DATA payloads straight
+// into the backend.
+func (l *LazyReceiver) negotiateCompression() error {
+	var p Packet
+	if err := l.conn.RecvMsg(&p); err != nil {
+		return err
+	}
+	if p.Type != PACKET_HELLO {
+		return errors.Errorf("expected hello packet, got %d", p.Type)
+	}
+	mine := supportedCompressions(CompressionNone)
+	return l.conn.SendMsg(&Packet{Type: PACKET_HELLO, Compressions: mine})
+}
+
+func NewLazyReceiver(ctx context.Context, conn Stream, backend PlaceholderBackend) *LazyReceiver {
+	return &LazyReceiver{
+		ctx:     ctx,
+		conn:    &syncStream{Stream: conn},
+		backend: backend,
+		ids:     make(map[string]uint32),
+		toc:     make(map[string]*Stat),
+		pending: make(map[uint32]chan *Packet),
+	}
+}
+
+func (l *LazyReceiver) Run() error {
+	if err := l.negotiateCompression(); err != nil {
+		return errors.Wrap(err, "failed to negotiate compression")
+	}
+	for {
+		var p Packet
+		if err := l.conn.RecvMsg(&p); err != nil {
+			return err
+		}
+		switch p.Type {
+		case PACKET_STAT:
+			if p.Stat == nil {
+				// TOC complete; keep reading so Fetch's later PACKET_REQ/
+				// PACKET_DATA exchanges still get dispatched.
+				break
+			}
+			if err := l.addToTOC(p.Stat); err != nil {
+				return err
+			}
+		case PACKET_DATA:
+			l.muPending.Lock()
+			ch, ok := l.pending[p.ID]
+			l.muPending.Unlock()
+			if ok {
+				ch <- &p
+			}
+		case PACKET_FIN:
+			return nil
+		}
+	}
+}
+
+func (l *LazyReceiver) addToTOC(stat *Stat) error {
+	l.mu.Lock()
+	id := l.next
+	l.next++
+	l.ids[stat.Path] = id
+	l.toc[stat.Path] = stat
+	l.mu.Unlock()
+	return l.backend.CreatePlaceholder(stat.Path, stat)
+}
+
+// Fetch requests length bytes at offset from path, blocking until they
+// arrive, meant to be called from the backend's first-read hook.
+func (l *LazyReceiver) Fetch(path string, offset, length int64) error {
+	l.mu.Lock()
+	id, ok := l.ids[path]
+	l.mu.Unlock()
+	if !ok {
+		return errors.Errorf("unknown lazy file %s", path)
+	}
+
+	ch := make(chan *Packet, 1)
+	l.muPending.Lock()
+	l.pending[id] = ch
+	l.muPending.Unlock()
+	defer func() {
+		l.muPending.Lock()
+		delete(l.pending, id)
+		l.muPending.Unlock()
+	}()
+
+	if err := l.conn.SendMsg(&Packet{Type: PACKET_REQ, ID: id, Offset: offset, Length: length}); err != nil {
+		return err
+	}
+
+	written := int64(0)
+	for written < length {
+		select {
+		case <-l.ctx.Done():
+			return l.ctx.Err()
+		case p := <-ch:
+			if len(p.Data) == 0 {
+				if written < length {
+					return io.ErrUnexpectedEOF
+				}
+				return nil
+			}
+			n, err := l.backend.WriteAt(path, offset+written, p.Data)
+			if err != nil {
+				return err
+			}
+			written += int64(n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package fsutil
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type fakeBackend struct {
+	mu      sync.Mutex
+	created map[string]*Stat
+	written map[string][]byte
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{created: map[string]*Stat{}, written: map[string][]byte{}}
+}
+
+func (b *fakeBackend) CreatePlaceholder(path string, stat *Stat) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.created[path] = stat
+	return nil
+}
+
+func (b *fakeBackend) WriteAt(path string, offset int64, p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf := b.written[path]
+	if need := int(offset) + len(p); len(buf) < need {
+		grown := make([]byte, need)
+		copy(grown, buf)
+		buf = grown
+	}
+	copy(buf[offset:], p)
+	b.written[path] = buf
+	return len(p), nil
+}
+
+// TestLazyReceiverFetch drives LazyReceiver against a hand-rolled sender so
+// it doesn't need a real Walk/Send: the handshake, TOC and a single range
+// fetch are exercised end to end.
+func TestLazyReceiverFetch(t *testing.T) {
+	toReceiver := make(chan Packet, 8)
+	toSender := make(chan Packet, 8)
+	conn := &benchStream{send: toSender, recv: toReceiver}
+
+	backend := newFakeBackend()
+	lr := NewLazyReceiver(context.Background(), conn, backend)
+
+	done := make(chan error, 1)
+	go func() { done <- lr.Run() }()
+
+	toReceiver <- Packet{Type: PACKET_HELLO, Compressions: []Compression{CompressionGzip}}
+	if hello := <-toSender; hello.Type != PACKET_HELLO {
+		t.Fatalf("expected hello reply, got %d", hello.Type)
+	}
+
+	toReceiver <- Packet{Type: PACKET_STAT, Stat: &Stat{Path: "foo"}}
+	toReceiver <- Packet{Type: PACKET_STAT}
+
+	fetchErr := make(chan error, 1)
+	go func() { fetchErr <- lr.Fetch("foo", 0, 5) }()
+
+	req := <-toSender
+	if req.Type != PACKET_REQ || req.ID != 0 {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	toReceiver <- Packet{Type: PACKET_DATA, ID: 0, Data: []byte("hello")}
+	toReceiver <- Packet{Type: PACKET_DATA, ID: 0}
+
+	if err := <-fetchErr; err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	backend.mu.Lock()
+	got := string(backend.written["foo"])
+	backend.mu.Unlock()
+	if got != "hello" {
+		t.Fatalf("expected backend to receive %q, got %q", "hello", got)
+	}
+
+	close(toReceiver)
+	<-done
+}
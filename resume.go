@@ -0,0 +1,168 @@
+package fsutil
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const journalFileName = ".fsutil-journal"
+
+// JournalEntry records the digest it was written against so a changed
+// source file can't be resumed from a stale offset.
+type JournalEntry struct {
+	Digest       digest.Digest `json:"digest"`
+	BytesWritten int64         `json:"bytesWritten"`
+}
+
+type Journal struct {
+	mu      sync.Mutex
+	dest    string
+	Entries map[string]JournalEntry `json:"entries"`
+}
+
+// LoadJournal returns an empty Journal if dest has none yet.
+func LoadJournal(dest string) (*Journal, error) {
+	j := &Journal{dest: dest, Entries: map[string]JournalEntry{}}
+	dt, err := ioutil.ReadFile(filepath.Join(dest, journalFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(dt, j); err != nil {
+		return nil, errors.Wrap(err, "failed to parse journal")
+	}
+	return j, nil
+}
+
+func (j *Journal) get(path string) (JournalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.Entries[path]
+	return e, ok
+}
+
+func (j *Journal) update(path string, dgst digest.Digest, written int64) error {
+	j.mu.Lock()
+	j.Entries[path] = JournalEntry{Digest: dgst, BytesWritten: written}
+	dt, err := json.Marshal(j)
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(j.dest, journalFileName), dt, 0600)
+}
+
+func SendResumable(ctx context.Context, conn Stream, root string, opt *WalkOpt, journal *Journal) error {
+	o := *opt
+	o.ResumeJournal = journal
+	return Send(ctx, conn, root, &o, nil)
+}
+
+func ReceiveResumable(ctx context.Context, conn Stream, dest string, journal *Journal) error {
+	return ReceiveWithOpt(ctx, conn, dest, ReceiveOpt{Journal: journal, Compression: CompressionGzip})
+}
+
+// openResumableDest truncates when starting from scratch and appends when
+// resuming, so a stale or mismatched destination never ends up with old
+// content followed by new content.
+func openResumableDest(path string, offset int64, mode os.FileMode) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset > 0 {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	return os.OpenFile(path, flags, mode)
+}
+
+// resumableDataFunc ignores the wc DiskWriter opened for this file: that fd
+// was created fresh (O_TRUNC) with no notion of a resume offset, so reusing
+// it would clobber any partial content before we even get to decide whether
+// to resume. Instead this opens its own fd against the real destination
+// mode, truncating or appending based on the journal, and only closes wc to
+// satisfy the same writeToFunc contract getAsyncDataFunc uses.
+func (r *receiver) resumableDataFunc(ctx context.Context, p string, id uint32, wc io.WriteCloser) error {
+	defer wc.Close()
+
+	entry, hasEntry := r.journal.get(p)
+	r.mu.RLock()
+	dgst := r.fileDigests[p]
+	mode, hasMode := r.fileModes[p]
+	r.mu.RUnlock()
+	if !hasMode {
+		mode = 0600
+	}
+	offset := int64(0)
+	if hasEntry && entry.Digest == dgst {
+		offset = entry.BytesWritten
+	}
+
+	f, err := openResumableDest(filepath.Join(r.dest, p), offset, mode)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s for resumable write", p)
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	r.muPipes.Lock()
+	r.pipes[id] = pw
+	r.muPipes.Unlock()
+	if err := r.conn.SendMsg(&Packet{Type: PACKET_REQ, ID: id, Offset: offset}); err != nil {
+		return err
+	}
+
+	dec, err := newDecoder(pr, r.compression)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	var storeWriter io.WriteCloser
+	dst := io.Writer(f)
+	if r.store != nil && dgst != "" {
+		sw, err := r.store.Writer(dgst)
+		if err != nil {
+			return err
+		}
+		storeWriter = sw
+		dst = io.MultiWriter(f, sw)
+	}
+
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	written := offset
+	for {
+		n, err := dec.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if serr := f.Sync(); serr != nil {
+				return serr
+			}
+			written += int64(n)
+			if jerr := r.journal.update(p, dgst, written); jerr != nil {
+				return jerr
+			}
+		}
+		if err == io.EOF {
+			if storeWriter != nil {
+				return storeWriter.Close()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
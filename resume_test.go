@@ -0,0 +1,220 @@
+package fsutil
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestJournalSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsutil-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := LoadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(j.Entries) != 0 {
+		t.Fatalf("expected empty journal, got %v", j.Entries)
+	}
+
+	dgst := digest.FromString("hello")
+	if err := j.update("foo", dgst, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	j2, err := LoadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := j2.get("foo")
+	if !ok || entry.Digest != dgst || entry.BytesWritten != 5 {
+		t.Fatalf("unexpected entry after reload: %+v, ok=%v", entry, ok)
+	}
+}
+
+func TestOpenResumableDestTruncatesOnMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsutil-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(path, []byte("stale-content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openResumableDest(path, 0, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dt, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "new" {
+		t.Fatalf("expected stale content to be truncated, got %q", dt)
+	}
+}
+
+// TestResumableDataFuncTruncatesOnDigestMismatch covers resuming into a
+// destination whose journal entry no longer matches the source file's
+// current digest: the partial write must be discarded, not appended to.
+func TestResumableDataFuncTruncatesOnDigestMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsutil-resume-mismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(path, []byte("stale-partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	staleDgst := digest.FromString("old source content")
+	newDgst := digest.FromString("new source content")
+
+	journal, err := LoadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.update("f", staleDgst, int64(len("stale-partial"))); err != nil {
+		t.Fatal(err)
+	}
+
+	toSender := make(chan Packet, 1)
+	r := &receiver{
+		dest:        dir,
+		journal:     journal,
+		fileDigests: map[string]digest.Digest{"f": newDgst},
+		conn:        &benchStream{send: toSender, recv: make(chan Packet)},
+		pipes:       map[uint32]*io.PipeWriter{},
+	}
+
+	var wc fakeWriteCloser
+	done := make(chan error, 1)
+	go func() { done <- r.resumableDataFunc(context.Background(), "f", 0, &wc) }()
+
+	req := <-toSender
+	if req.Offset != 0 {
+		t.Fatalf("expected a mismatched digest to restart from offset 0, got %d", req.Offset)
+	}
+
+	r.muPipes.RLock()
+	pw := r.pipes[0]
+	r.muPipes.RUnlock()
+	if _, err := pw.Write([]byte("fresh")); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	dt, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "fresh" {
+		t.Fatalf("expected stale partial content to be truncated, got %q", dt)
+	}
+
+	entry, ok := journal.get("f")
+	if !ok || entry.Digest != newDgst || entry.BytesWritten != int64(len("fresh")) {
+		t.Fatalf("expected journal updated against new digest, got %+v, ok=%v", entry, ok)
+	}
+}
+
+// TestResumableDataFuncUsesStatMode covers that the fd resumableDataFunc
+// opens itself is created with the source file's real mode rather than a
+// hardcoded default, since it can't reuse the wc DiskWriter already opened.
+func TestResumableDataFuncUsesStatMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsutil-resume-mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal, err := LoadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toSender := make(chan Packet, 1)
+	r := &receiver{
+		dest:      dir,
+		journal:   journal,
+		fileModes: map[string]os.FileMode{"f": 0640},
+		conn:      &benchStream{send: toSender, recv: make(chan Packet)},
+		pipes:     map[uint32]*io.PipeWriter{},
+	}
+
+	var wc fakeWriteCloser
+	done := make(chan error, 1)
+	go func() { done <- r.resumableDataFunc(context.Background(), "f", 0, &wc) }()
+
+	<-toSender
+
+	r.muPipes.RLock()
+	pw := r.pipes[0]
+	r.muPipes.RUnlock()
+	pw.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("expected destination to keep mode 0640, got %v", fi.Mode().Perm())
+	}
+}
+
+func TestOpenResumableDestAppendsOnResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsutil-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(path, []byte("part1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openResumableDest(path, 5, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("part2")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dt, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dt) != "part1part2" {
+		t.Fatalf("expected resumed write to append, got %q", dt)
+	}
+}